@@ -15,13 +15,16 @@
 package device
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -29,49 +32,77 @@ import (
 	"time"
 )
 
-// ClearCrypto clears all the temporary crypto files of the Device.
+// KeyAlgorithm identifies the asymmetric algorithm used to generate a Device's
+// private key.
+type KeyAlgorithm int
+
+const (
+	// KeyRSA2048 generates a 2048 bit RSA key. This is the historical default.
+	KeyRSA2048 KeyAlgorithm = iota
+	// KeyRSA4096 generates a 4096 bit RSA key.
+	KeyRSA4096
+	// KeyECDSAP256 generates an ECDSA key on the NIST P-256 curve.
+	KeyECDSAP256
+	// KeyECDSAP384 generates an ECDSA key on the NIST P-384 curve.
+	KeyECDSAP384
+	// KeyEd25519 generates an Ed25519 key.
+	KeyEd25519
+)
+
+// ClearCrypto clears all the credentials held by the Device's KeyStore.
 // Usually, you shouldn't need to call this function.
 func (d *Device) ClearCrypto() error {
-	// Delete all files in the crypto dir
-	cryptoDir := d.getCryptoDir()
-	dirRead, err := os.Open(cryptoDir)
-	if err != nil {
-		return err
-	}
-	dirFiles, err := dirRead.Readdir(0)
+	keyStore, err := d.getKeyStore()
 	if err != nil {
 		return err
 	}
+	return keyStore.Clear()
+}
 
-	// Loop over the directory's files.
-	for index := range dirFiles {
-		// Remove the file.
-		if err := os.Remove(filepath.Join(cryptoDir, dirFiles[index].Name())); err != nil {
-			return err
+// getKeyStore returns the Device's configured KeyStore, defaulting to a
+// FileKeyStore rooted at persistencyDir/crypto for backwards compatibility
+// with Devices that don't set KeyStore explicitly. getKeyStore is called
+// from both the main connect/publish path and the background certificate
+// renewal loop, so the lazy default is guarded by a mutex rather than a bare
+// check-then-set - a sync.Once would work for the race but would also
+// permanently wedge the Device on nil if the directory wasn't accessible
+// yet on the first call, with no way to recover once it becomes available.
+// It returns an error rather than a nil KeyStore so that callers fail
+// cleanly instead of panicking on a nil method call.
+func (d *Device) getKeyStore() (KeyStore, error) {
+	d.keyStoreMutex.Lock()
+	defer d.keyStoreMutex.Unlock()
+
+	if d.KeyStore == nil {
+		fileStore, err := NewFileKeyStore(d.getCryptoDir())
+		if err != nil {
+			return nil, fmt.Errorf("could not access crypto dir: %w", err)
 		}
+		d.KeyStore = fileStore
 	}
-
-	return nil
+	return d.KeyStore, nil
 }
 
 func (d *Device) hasValidCertificate() bool {
-	// Does the certificate exist?
-	_, err := tls.LoadX509KeyPair(filepath.Join(d.getCryptoDir(), "device.crt"),
-		filepath.Join(d.getCryptoDir(), "device.key"))
+	keyStore, err := d.getKeyStore()
 	if err != nil {
 		return false
 	}
 
-	// In this case, load the certificate (LoadX509KeyPair won't work here)
-	r, err := ioutil.ReadFile(filepath.Join(d.getCryptoDir(), "device.crt"))
+	// Go through TLSCertificate, not LoadCertificate, so that a cert/key
+	// mismatch (e.g. a key regenerated independently of its certificate)
+	// is caught here rather than surfacing as a TLS handshake failure with
+	// no path back to re-registration.
+	tlsCert, err := keyStore.TLSCertificate()
 	if err != nil {
 		return false
 	}
+	if len(tlsCert.Certificate) == 0 {
+		return false
+	}
 
-	block, _ := pem.Decode(r)
-	cert, err := x509.ParseCertificate(block.Bytes)
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
 	if err != nil {
-		// Didn't work
 		return false
 	}
 
@@ -80,17 +111,30 @@ func (d *Device) hasValidCertificate() bool {
 }
 
 func (d *Device) getTLSConfig() (*tls.Config, error) {
-	// Load Device certificate
-	cert, err := tls.LoadX509KeyPair(filepath.Join(d.getCryptoDir(), "device.crt"),
-		filepath.Join(d.getCryptoDir(), "device.key"))
+	keyStore, err := d.getKeyStore()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := keyStore.TLSCertificate()
 	if err != nil {
 		return nil, err
 	}
 
+	if err := d.checkOwnCertificateRevocation(cert); err != nil {
+		return nil, err
+	}
+
 	tlsConfig := new(tls.Config)
 	tlsConfig.Certificates = []tls.Certificate{cert}
 	tlsConfig.RootCAs = d.RootCAs
 	tlsConfig.InsecureSkipVerify = d.IgnoreSSLErrors
+	tlsConfig.VerifyPeerCertificate = d.buildVerifyPeerCertificate()
+
+	// Every connection attempt builds a tls.Config, so this is the one place
+	// guaranteed to run early enough, and often enough, to get the
+	// certificate renewal loop going for the lifetime of the Device.
+	d.ensureCertificateRenewalLoopStarted()
 
 	return tlsConfig, nil
 }
@@ -103,12 +147,21 @@ func (d *Device) getCryptoDir() string {
 	return cryptoDir
 }
 
+// getCSRFilePath returns the path of the CSR the Device uses to request its
+// certificate. Unlike the key and certificate, the CSR isn't part of the
+// KeyStore: it's a transient artifact only needed until Pairing issues a
+// certificate for it.
+func (d *Device) getCSRFilePath() string {
+	return filepath.Join(d.getCryptoDir(), "device.csr")
+}
+
 func (d *Device) ensureCSR() error {
-	if err := d.ensureKeyPair(); err != nil {
+	privateKey, err := d.ensureKeyPair()
+	if err != nil {
 		return err
 	}
 
-	csrFilename := filepath.Join(d.getCryptoDir(), "device.csr")
+	csrFilename := d.getCSRFilePath()
 	if _, err := os.Stat(csrFilename); err == nil {
 		// The file exists, we're fine
 		return nil
@@ -120,29 +173,7 @@ func (d *Device) ensureCSR() error {
 			CommonName:   fmt.Sprintf("%s/%s", d.realm, d.deviceID),
 			Organization: []string{"Devices"},
 		},
-		SignatureAlgorithm: x509.SHA256WithRSA,
-	}
-
-	// Get the private key
-	priv, err := ioutil.ReadFile(filepath.Join(d.getCryptoDir(), "device.key"))
-	if err != nil {
-		return err
-	}
-	privPem, _ := pem.Decode(priv)
-	if privPem == nil {
-		return errors.New("Corrupted data in Device Private key, clearing the crypto store")
-	}
-
-	var parsedKey interface{}
-	if parsedKey, err = x509.ParsePKCS1PrivateKey(privPem.Bytes); err != nil {
-		if parsedKey, err = x509.ParsePKCS8PrivateKey(privPem.Bytes); err != nil { // note this returns type `interface{}`
-			return err
-		}
-	}
-
-	privateKey, ok := parsedKey.(*rsa.PrivateKey)
-	if !ok {
-		return errors.New("Unable to parse RSA private key, clearing the crypto store")
+		SignatureAlgorithm: signatureAlgorithmFor(d.KeyAlgorithm),
 	}
 
 	// Sign
@@ -169,72 +200,91 @@ func (d *Device) ensureCSR() error {
 }
 
 func (d *Device) getCSRString() (string, error) {
-	b, err := ioutil.ReadFile(filepath.Join(d.getCryptoDir(), "device.csr"))
+	b, err := ioutil.ReadFile(d.getCSRFilePath())
 	if err != nil {
 		return "", err
 	}
 	return string(b), nil
 }
 
-func (d *Device) ensureKeyPair() error {
-	keyFile := filepath.Join(d.getCryptoDir(), "device.key")
-	if _, err := os.Stat(keyFile); err == nil {
-		// The file exists, we're fine
-		return nil
-	}
-
-	// We need to generate the key
-	// First of all, clear the crypto dir, just to be sure.
-	if err := d.ClearCrypto(); err != nil {
-		return err
-	}
-
-	reader := rand.Reader
-	// Certificates are short-lived, 2048 is fine.
-	bitSize := 2048
-
-	key, err := rsa.GenerateKey(reader, bitSize)
+// ensureKeyPair makes sure the Device has a private key, generating one
+// through its KeyStore if necessary, and returns it.
+func (d *Device) ensureKeyPair() (crypto.Signer, error) {
+	keyStore, err := d.getKeyStore()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return keyStore.LoadOrGenerateKey(d.KeyAlgorithm)
+}
 
-	publicKey := key.PublicKey
+// generateKey generates a new private key using the given algorithm. Keys are
+// always returned as a crypto.Signer so that callers don't need to care about
+// the concrete type backing the algorithm.
+func generateKey(algo KeyAlgorithm) (crypto.Signer, error) {
+	switch algo {
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm: %v", algo)
+	}
+}
 
-	if err := savePublicPEMKey(filepath.Join(d.getCryptoDir(), "device.pub"), publicKey); err != nil {
-		return err
+// signatureAlgorithmFor returns the x509.SignatureAlgorithm matching the
+// key algorithm used to generate the Device's private key.
+func signatureAlgorithmFor(algo KeyAlgorithm) x509.SignatureAlgorithm {
+	switch algo {
+	case KeyECDSAP256:
+		return x509.ECDSAWithSHA256
+	case KeyECDSAP384:
+		return x509.ECDSAWithSHA384
+	case KeyEd25519:
+		return x509.PureEd25519
+	default:
+		return x509.SHA256WithRSA
 	}
-	return savePEMKey(keyFile, key)
 }
 
 func (d *Device) saveCertificateFromString(certificateString string) error {
-	certFile := filepath.Join(d.getCryptoDir(), "device.crt")
-	// Attempt loading the certificate to ensure we can use it
-	p, _ := pem.Decode([]byte(certificateString))
-	if p == nil {
-		return errors.New("Could not decode PEM certificate")
+	keyStore, err := d.getKeyStore()
+	if err != nil {
+		return err
 	}
-
-	// If it worked, just write the file and call it a day.
-	return ioutil.WriteFile(certFile, []byte(certificateString), 0600)
+	return keyStore.SaveCertificate([]byte(certificateString))
 }
 
-func savePEMKey(fileName string, key *rsa.PrivateKey) error {
+func savePEMKey(fileName string, key crypto.Signer) error {
 	outFile, err := os.Create(fileName)
 	if err != nil {
 		return err
 	}
 	defer outFile.Close()
 
-	var privateKey = &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	// PKCS#8 is used for every algorithm so that device.key is uniform
+	// regardless of which KeyAlgorithm generated it.
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	privateKey := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBytes,
 	}
 
 	return pem.Encode(outFile, privateKey)
 }
 
-func savePublicPEMKey(fileName string, pubkey rsa.PublicKey) error {
-	pkixBytes, err := x509.MarshalPKIXPublicKey(&pubkey)
+func savePublicPEMKey(fileName string, pubkey crypto.PublicKey) error {
+	pkixBytes, err := x509.MarshalPKIXPublicKey(pubkey)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,108 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+	cases := []struct {
+		name    string
+		algo    KeyAlgorithm
+		checkFn func(t *testing.T, key interface{})
+	}{
+		{"RSA2048", KeyRSA2048, func(t *testing.T, key interface{}) {
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				t.Fatalf("expected *rsa.PrivateKey, got %T", key)
+			}
+			if bits := rsaKey.N.BitLen(); bits != 2048 {
+				t.Errorf("expected a 2048 bit key, got %d", bits)
+			}
+		}},
+		{"RSA4096", KeyRSA4096, func(t *testing.T, key interface{}) {
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				t.Fatalf("expected *rsa.PrivateKey, got %T", key)
+			}
+			if bits := rsaKey.N.BitLen(); bits != 4096 {
+				t.Errorf("expected a 4096 bit key, got %d", bits)
+			}
+		}},
+		{"ECDSAP256", KeyECDSAP256, func(t *testing.T, key interface{}) {
+			ecKey, ok := key.(*ecdsa.PrivateKey)
+			if !ok {
+				t.Fatalf("expected *ecdsa.PrivateKey, got %T", key)
+			}
+			if ecKey.Curve.Params().Name != "P-256" {
+				t.Errorf("expected P-256, got %s", ecKey.Curve.Params().Name)
+			}
+		}},
+		{"ECDSAP384", KeyECDSAP384, func(t *testing.T, key interface{}) {
+			ecKey, ok := key.(*ecdsa.PrivateKey)
+			if !ok {
+				t.Fatalf("expected *ecdsa.PrivateKey, got %T", key)
+			}
+			if ecKey.Curve.Params().Name != "P-384" {
+				t.Errorf("expected P-384, got %s", ecKey.Curve.Params().Name)
+			}
+		}},
+		{"Ed25519", KeyEd25519, func(t *testing.T, key interface{}) {
+			if _, ok := key.(ed25519.PrivateKey); !ok {
+				t.Fatalf("expected ed25519.PrivateKey, got %T", key)
+			}
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			key, err := generateKey(c.algo)
+			if err != nil {
+				t.Fatalf("generateKey(%v) returned an error: %v", c.algo, err)
+			}
+			c.checkFn(t, key)
+		})
+	}
+}
+
+func TestGenerateKeyUnsupportedAlgorithm(t *testing.T) {
+	if _, err := generateKey(KeyAlgorithm(-1)); err == nil {
+		t.Fatal("expected an error for an unsupported KeyAlgorithm, got nil")
+	}
+}
+
+func TestSignatureAlgorithmFor(t *testing.T) {
+	cases := []struct {
+		algo     KeyAlgorithm
+		expected x509.SignatureAlgorithm
+	}{
+		{KeyRSA2048, x509.SHA256WithRSA},
+		{KeyRSA4096, x509.SHA256WithRSA},
+		{KeyECDSAP256, x509.ECDSAWithSHA256},
+		{KeyECDSAP384, x509.ECDSAWithSHA384},
+		{KeyEd25519, x509.PureEd25519},
+	}
+
+	for _, c := range cases {
+		if got := signatureAlgorithmFor(c.algo); got != c.expected {
+			t.Errorf("signatureAlgorithmFor(%v) = %v, want %v", c.algo, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// KeyStore abstracts away where a Device's private key and certificate live
+// and how they're accessed. The default FileKeyStore keeps PEM files under
+// the persistency directory, exactly like earlier versions of this package
+// did, but a Device can be configured with any other implementation -
+// InMemoryKeyStore for ephemeral/containerized devices, or PKCS11KeyStore for
+// devices whose key must never leave an HSM or TPM.
+type KeyStore interface {
+	// LoadOrGenerateKey returns the Device's private key, generating one with
+	// the given KeyAlgorithm if none exists yet.
+	LoadOrGenerateKey(algo KeyAlgorithm) (crypto.Signer, error)
+	// LoadCertificate returns the Device's current certificate, if any.
+	LoadCertificate() (*x509.Certificate, error)
+	// SaveCertificate persists a PEM-encoded certificate, replacing the
+	// previous one.
+	SaveCertificate(certificatePEM []byte) error
+	// Clear wipes every credential owned by the KeyStore, forcing a fresh
+	// key and certificate to be issued next time they're needed.
+	Clear() error
+	// TLSCertificate returns the key and certificate pair ready to be used in
+	// a tls.Config, without requiring the caller to know how the private key
+	// is actually stored.
+	TLSCertificate() (tls.Certificate, error)
+}
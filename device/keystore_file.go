@@ -0,0 +1,188 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileKeyStore is the default KeyStore implementation, storing the Device's
+// private key, public key and certificate as PEM files in a directory on
+// disk. This is the behavior this package has always had.
+type FileKeyStore struct {
+	// Dir is the directory the key and certificate PEM files live in. It must
+	// already exist.
+	Dir string
+}
+
+// NewFileKeyStore returns a FileKeyStore rooted at dir, creating dir if it
+// doesn't exist yet.
+func NewFileKeyStore(dir string) (*FileKeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileKeyStore{Dir: dir}, nil
+}
+
+func (f *FileKeyStore) keyFile() string { return filepath.Join(f.Dir, "device.key") }
+func (f *FileKeyStore) pubFile() string { return filepath.Join(f.Dir, "device.pub") }
+func (f *FileKeyStore) crtFile() string { return filepath.Join(f.Dir, "device.crt") }
+
+func (f *FileKeyStore) LoadOrGenerateKey(algo KeyAlgorithm) (crypto.Signer, error) {
+	if _, err := os.Stat(f.keyFile()); err == nil {
+		return f.loadKey()
+	}
+
+	// We need to generate the key. First of all, clear the store, just to be
+	// sure we don't end up with a key/certificate mismatch.
+	if err := f.Clear(); err != nil {
+		return nil, err
+	}
+
+	key, err := generateKey(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := savePublicPEMKey(f.pubFile(), key.Public()); err != nil {
+		return nil, err
+	}
+	if err := savePEMKey(f.keyFile(), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ImportKey persists an externally-provided private key (e.g. decoded from a
+// PKCS#12 blob by ImportPKCS12), replacing whatever key was previously
+// stored.
+func (f *FileKeyStore) ImportKey(key crypto.Signer) error {
+	if err := f.Clear(); err != nil {
+		return err
+	}
+	if err := savePublicPEMKey(f.pubFile(), key.Public()); err != nil {
+		return err
+	}
+	return savePEMKey(f.keyFile(), key)
+}
+
+func (f *FileKeyStore) loadKey() (crypto.Signer, error) {
+	priv, err := ioutil.ReadFile(f.keyFile())
+	if err != nil {
+		return nil, err
+	}
+	privPem, _ := pem.Decode(priv)
+	if privPem == nil {
+		return nil, errors.New("Corrupted data in Device Private key, clearing the crypto store")
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(privPem.Bytes)
+	if err != nil {
+		// Keys written by earlier versions of this package are PKCS#1 RSA keys.
+		rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(privPem.Bytes)
+		if rsaErr != nil {
+			return nil, err
+		}
+		return rsaKey, nil
+	}
+
+	signer, ok := parsedKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unable to parse Device private key, clearing the crypto store")
+	}
+
+	return signer, nil
+}
+
+func (f *FileKeyStore) LoadCertificate() (*x509.Certificate, error) {
+	r, err := ioutil.ReadFile(f.crtFile())
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(r)
+	if block == nil {
+		return nil, errors.New("Could not decode PEM certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func (f *FileKeyStore) SaveCertificate(certificatePEM []byte) error {
+	// Attempt loading the certificate to ensure we can use it
+	if p, _ := pem.Decode(certificatePEM); p == nil {
+		return errors.New("Could not decode PEM certificate")
+	}
+
+	// Write to a temp file and rename into place so a crash or power loss
+	// mid-write can never leave a truncated device.crt behind - the rename
+	// either lands the new certificate whole, or doesn't land at all.
+	crtFile := f.crtFile()
+	tmpFile, err := ioutil.TempFile(f.Dir, "device.crt.tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	if _, err := tmpFile.Write(certificatePEM); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := os.Rename(tmpName, crtFile); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+func (f *FileKeyStore) Clear() error {
+	dirRead, err := os.Open(f.Dir)
+	if err != nil {
+		return err
+	}
+	dirFiles, err := dirRead.Readdir(0)
+	if err != nil {
+		return err
+	}
+
+	// Loop over the directory's files.
+	for index := range dirFiles {
+		// Remove the file.
+		if err := os.Remove(filepath.Join(f.Dir, dirFiles[index].Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *FileKeyStore) TLSCertificate() (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(f.crtFile(), f.keyFile())
+}
@@ -0,0 +1,123 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"sync"
+)
+
+// InMemoryKeyStore is a KeyStore that never touches disk. The key and
+// certificate live only for the lifetime of the process, which makes it a
+// good fit for ephemeral devices and short-lived containers where a
+// persistency directory isn't available or isn't trusted.
+type InMemoryKeyStore struct {
+	mutex   sync.Mutex
+	key     crypto.Signer
+	cert    *x509.Certificate
+	certPEM []byte
+}
+
+// NewInMemoryKeyStore returns an empty InMemoryKeyStore.
+func NewInMemoryKeyStore() *InMemoryKeyStore {
+	return &InMemoryKeyStore{}
+}
+
+func (m *InMemoryKeyStore) LoadOrGenerateKey(algo KeyAlgorithm) (crypto.Signer, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.key != nil {
+		return m.key, nil
+	}
+
+	key, err := generateKey(algo)
+	if err != nil {
+		return nil, err
+	}
+	m.key = key
+	return m.key, nil
+}
+
+// ImportKey stores an externally-provided private key (e.g. decoded from a
+// PKCS#12 blob by ImportPKCS12), replacing whatever key was previously held.
+func (m *InMemoryKeyStore) ImportKey(key crypto.Signer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.key = key
+	m.cert = nil
+	m.certPEM = nil
+	return nil
+}
+
+func (m *InMemoryKeyStore) LoadCertificate() (*x509.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.cert == nil {
+		return nil, errors.New("no certificate stored")
+	}
+	return m.cert, nil
+}
+
+func (m *InMemoryKeyStore) SaveCertificate(certificatePEM []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return errors.New("Could not decode PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	m.cert = cert
+	m.certPEM = certificatePEM
+	return nil
+}
+
+func (m *InMemoryKeyStore) Clear() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.key = nil
+	m.cert = nil
+	m.certPEM = nil
+	return nil
+}
+
+func (m *InMemoryKeyStore) TLSCertificate() (tls.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.key == nil || m.certPEM == nil {
+		return tls.Certificate{}, errors.New("no key/certificate pair stored")
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(m.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+	return tls.X509KeyPair(m.certPEM, keyPEM)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestInMemoryKeyStoreGenerateSaveReload(t *testing.T) {
+	for _, algo := range []KeyAlgorithm{KeyRSA2048, KeyRSA4096, KeyECDSAP256, KeyECDSAP384, KeyEd25519} {
+		t.Run(algoName(algo), func(t *testing.T) {
+			store := NewInMemoryKeyStore()
+
+			key, err := store.LoadOrGenerateKey(algo)
+			if err != nil {
+				t.Fatalf("LoadOrGenerateKey failed: %v", err)
+			}
+
+			// A second call must reuse the same key rather than generating a
+			// new one.
+			reloaded, err := store.LoadOrGenerateKey(algo)
+			if err != nil {
+				t.Fatalf("LoadOrGenerateKey (reload) failed: %v", err)
+			}
+			if !publicKeysEqual(t, key.Public(), reloaded.Public()) {
+				t.Error("reloaded key does not match the originally generated key")
+			}
+
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "myrealm/mydevice"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+			if err != nil {
+				t.Fatalf("x509.CreateCertificate failed: %v", err)
+			}
+			certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+			if err := store.SaveCertificate(certPEM); err != nil {
+				t.Fatalf("SaveCertificate failed: %v", err)
+			}
+
+			cert, err := store.LoadCertificate()
+			if err != nil {
+				t.Fatalf("LoadCertificate failed: %v", err)
+			}
+			if cert.Subject.CommonName != "myrealm/mydevice" {
+				t.Errorf("LoadCertificate CommonName = %q, want %q", cert.Subject.CommonName, "myrealm/mydevice")
+			}
+
+			tlsCert, err := store.TLSCertificate()
+			if err != nil {
+				t.Fatalf("TLSCertificate failed: %v", err)
+			}
+			if len(tlsCert.Certificate) == 0 {
+				t.Fatal("TLSCertificate returned no certificate chain")
+			}
+		})
+	}
+}
+
+func TestInMemoryKeyStoreClear(t *testing.T) {
+	store := NewInMemoryKeyStore()
+
+	if _, err := store.LoadOrGenerateKey(KeyECDSAP256); err != nil {
+		t.Fatalf("LoadOrGenerateKey failed: %v", err)
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+
+	if _, err := store.LoadCertificate(); err == nil {
+		t.Error("expected LoadCertificate to fail after Clear, got nil")
+	}
+	if _, err := store.TLSCertificate(); err == nil {
+		t.Error("expected TLSCertificate to fail after Clear, got nil")
+	}
+}
+
+func TestInMemoryKeyStoreLoadCertificateBeforeSave(t *testing.T) {
+	store := NewInMemoryKeyStore()
+
+	if _, err := store.LoadCertificate(); err == nil {
+		t.Fatal("expected an error loading a certificate that was never saved, got nil")
+	}
+}
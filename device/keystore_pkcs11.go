@@ -0,0 +1,181 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build pkcs11
+
+package device
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11KeyStore is a STUB KeyStore for a PKCS#11 token (an HSM or a TPM
+// exposing a PKCS#11 shim). It establishes and authenticates a PKCS#11
+// session, which is the vendor-agnostic part of the job, but key lookup and
+// on-token generation (findKey/generateKeyOnToken) are left unimplemented:
+// mapping a KeyAlgorithm to a concrete PKCS#11 mechanism and object template
+// is token/vendor specific, and guessing at one generically would be worse
+// than refusing to pretend it works. Every LoadOrGenerateKey/TLSCertificate
+// call currently returns an error - treat this as a starting point to wire
+// up against a specific token, not a working backend.
+//
+// Building with PKCS11KeyStore requires the "pkcs11" build tag and a
+// PKCS#11 module (e.g. SoftHSM2, or a vendor-provided TPM shim) available at
+// runtime.
+type PKCS11KeyStore struct {
+	ctx        *pkcs11.Ctx
+	session    pkcs11.SessionHandle
+	tokenLabel string
+	keyLabel   string
+	pin        string
+
+	cert *x509.Certificate
+}
+
+// NewPKCS11KeyStore opens a session against the PKCS#11 module at modulePath,
+// logging into the token identified by tokenLabel with pin, and scoping all
+// key operations to objects labeled keyLabel.
+func NewPKCS11KeyStore(modulePath, tokenLabel, keyLabel, pin string) (*PKCS11KeyStore, error) {
+	ctx := pkcs11.New(modulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: could not load module %q", modulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, err
+	}
+
+	slot, err := findSlotForToken(ctx, tokenLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		return nil, err
+	}
+
+	return &PKCS11KeyStore{
+		ctx:        ctx,
+		session:    session,
+		tokenLabel: tokenLabel,
+		keyLabel:   keyLabel,
+		pin:        pin,
+	}, nil
+}
+
+func findSlotForToken(ctx *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if info.Label == tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("pkcs11: no token labeled %q found", tokenLabel)
+}
+
+// LoadOrGenerateKey returns a crypto.Signer whose private operations are
+// delegated to the token; if no key labeled keyLabel exists yet, one is
+// generated on-token using algo and never extracted. With findKey and
+// generateKeyOnToken unimplemented, every call returns an error.
+func (p *PKCS11KeyStore) LoadOrGenerateKey(algo KeyAlgorithm) (crypto.Signer, error) {
+	signer, err := p.findKey()
+	if err == nil {
+		return signer, nil
+	}
+
+	if err := p.generateKeyOnToken(algo); err != nil {
+		return nil, err
+	}
+
+	return p.findKey()
+}
+
+// findKey is unimplemented: see the PKCS11KeyStore doc comment.
+func (p *PKCS11KeyStore) findKey() (crypto.Signer, error) {
+	return nil, errors.New("pkcs11: key lookup is not implemented - PKCS11KeyStore is a stub, see its doc comment")
+}
+
+// generateKeyOnToken is unimplemented: see the PKCS11KeyStore doc comment.
+func (p *PKCS11KeyStore) generateKeyOnToken(algo KeyAlgorithm) error {
+	return errors.New("pkcs11: key generation is not implemented - PKCS11KeyStore is a stub, see its doc comment")
+}
+
+func (p *PKCS11KeyStore) LoadCertificate() (*x509.Certificate, error) {
+	if p.cert == nil {
+		return nil, errors.New("no certificate stored")
+	}
+	return p.cert, nil
+}
+
+func (p *PKCS11KeyStore) SaveCertificate(certificatePEM []byte) error {
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return errors.New("Could not decode PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	p.cert = cert
+	return nil
+}
+
+// TLSCertificate returns a tls.Certificate whose PrivateKey is the
+// token-backed crypto.Signer, so that private key material never leaves the
+// HSM/TPM even while the certificate is being used for the mTLS handshake.
+// It will return an error until findKey is implemented for a real token -
+// see the PKCS11KeyStore doc comment.
+func (p *PKCS11KeyStore) TLSCertificate() (tls.Certificate, error) {
+	signer, err := p.findKey()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if p.cert == nil {
+		return tls.Certificate{}, errors.New("no certificate stored")
+	}
+	if matcher, ok := p.cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && !matcher.Equal(signer.Public()) {
+		return tls.Certificate{}, errors.New("pkcs11: stored certificate does not match the token's private key")
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{p.cert.Raw},
+		PrivateKey:  signer,
+		Leaf:        p.cert,
+	}, nil
+}
+
+// Clear logs out of the token. It intentionally does not destroy the
+// on-token key: a HSM-backed key is provisioned out of band and isn't
+// something this package should be able to delete.
+func (p *PKCS11KeyStore) Clear() error {
+	p.cert = nil
+	return p.ctx.Logout(p.session)
+}
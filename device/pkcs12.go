@@ -0,0 +1,107 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ExportPKCS12 bundles the Device's private key and certificate into a
+// password-protected PKCS#12 blob, so that the identity provisioned by
+// Astarte can be handed to tools that expect a .p12/.pfx file (mosquitto,
+// browsers, provisioning suites) or simply archived for backup/migration.
+//
+// The CA chain isn't included: RootCAs is a *x509.CertPool, which doesn't
+// expose the certificates it was built from, so there's nothing to bundle
+// beyond the device's own key and certificate.
+func (d *Device) ExportPKCS12(password string) ([]byte, error) {
+	keyStore, err := d.getKeyStore()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCert, err := keyStore.TLSCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs12.Encode(rand.Reader, tlsCert.PrivateKey, cert, nil, password)
+}
+
+// ImportPKCS12 decodes a PKCS#12 blob produced by ExportPKCS12 (or by any
+// other tool bundling a matching key/certificate pair) and persists the key
+// and certificate, exactly as if they had been provisioned through the usual
+// registration flow.
+//
+// Importing a specific private key is only meaningful for a FileKeyStore (or
+// another KeyStore that's willing to accept foreign key material) - it
+// doesn't make sense for an HSM/TPM-backed KeyStore, since a software key
+// can't be pushed into hardware after the fact.
+func (d *Device) ImportPKCS12(data []byte, password string) error {
+	privateKey, cert, err := pkcs12.Decode(data, password)
+	if err != nil {
+		return err
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("pkcs12: unsupported private key type %T", privateKey)
+	}
+
+	if err := validateImportedCertificateCN(cert, d.realm, d.deviceID); err != nil {
+		return err
+	}
+
+	keyStore, err := d.getKeyStore()
+	if err != nil {
+		return err
+	}
+
+	importer, ok := keyStore.(interface {
+		ImportKey(crypto.Signer) error
+	})
+	if !ok {
+		return fmt.Errorf("pkcs12: the configured KeyStore (%T) does not support importing an external key", keyStore)
+	}
+
+	if err := importer.ImportKey(signer); err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return keyStore.SaveCertificate(certPEM)
+}
+
+// validateImportedCertificateCN makes sure a certificate being imported
+// actually belongs to this device, rejecting a PKCS#12 blob provisioned for
+// a different realm/deviceID.
+func validateImportedCertificateCN(cert *x509.Certificate, realm, deviceID string) error {
+	expectedCN := fmt.Sprintf("%s/%s", realm, deviceID)
+	if cert.Subject.CommonName != expectedCN {
+		return fmt.Errorf("pkcs12: certificate CommonName %q does not match device identity %q", cert.Subject.CommonName, expectedCN)
+	}
+	return nil
+}
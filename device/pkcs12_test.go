@@ -0,0 +1,110 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// selfSignedCert generates a throwaway key/certificate pair with the given
+// CommonName, for exercising the PKCS#12 encode/decode path without needing
+// a live Device or a Pairing server.
+func selfSignedCert(t *testing.T, commonName string) (crypto.Signer, *x509.Certificate) {
+	t.Helper()
+
+	key, err := generateKey(KeyECDSAP256)
+	if err != nil {
+		t.Fatalf("generateKey failed: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %v", err)
+	}
+
+	return key, cert
+}
+
+func TestPKCS12RoundTrip(t *testing.T) {
+	const password = "s3cr3t"
+	key, cert := selfSignedCert(t, "myrealm/mydevice")
+
+	blob, err := pkcs12.Encode(rand.Reader, key, cert, nil, password)
+	if err != nil {
+		t.Fatalf("pkcs12.Encode failed: %v", err)
+	}
+
+	decodedKey, decodedCert, err := pkcs12.Decode(blob, password)
+	if err != nil {
+		t.Fatalf("pkcs12.Decode failed: %v", err)
+	}
+
+	if decodedCert.Subject.CommonName != cert.Subject.CommonName {
+		t.Errorf("decoded CommonName = %q, want %q", decodedCert.Subject.CommonName, cert.Subject.CommonName)
+	}
+
+	signer, ok := decodedKey.(crypto.Signer)
+	if !ok {
+		t.Fatalf("decoded private key is not a crypto.Signer, got %T", decodedKey)
+	}
+	if matcher, ok := decodedCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !matcher.Equal(signer.Public()) {
+		t.Error("decoded certificate's public key does not match the decoded private key")
+	}
+}
+
+func TestPKCS12RoundTripWrongPassword(t *testing.T) {
+	key, cert := selfSignedCert(t, "myrealm/mydevice")
+
+	blob, err := pkcs12.Encode(rand.Reader, key, cert, nil, "correct-password")
+	if err != nil {
+		t.Fatalf("pkcs12.Encode failed: %v", err)
+	}
+
+	if _, _, err := pkcs12.Decode(blob, "wrong-password"); err == nil {
+		t.Fatal("expected an error decoding with the wrong password, got nil")
+	}
+}
+
+func TestValidateImportedCertificateCN(t *testing.T) {
+	_, cert := selfSignedCert(t, "myrealm/mydevice")
+
+	if err := validateImportedCertificateCN(cert, "myrealm", "mydevice"); err != nil {
+		t.Errorf("expected a matching realm/deviceID to validate, got: %v", err)
+	}
+
+	if err := validateImportedCertificateCN(cert, "otherrealm", "mydevice"); err == nil {
+		t.Error("expected a mismatched realm to be rejected, got nil")
+	}
+}
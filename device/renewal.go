@@ -0,0 +1,211 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"os"
+	"time"
+)
+
+// CertificateRenewedHandler is called after the background renewal loop has
+// successfully replaced the Device's certificate.
+type CertificateRenewedHandler func(d *Device)
+
+// CertificateRenewalFailedHandler is called when the background renewal loop
+// attempted to renew the Device's certificate but failed. The Device keeps
+// using its current certificate and will retry on the next check.
+type CertificateRenewalFailedHandler func(d *Device, err error)
+
+// RequestCertificateFunc asks Pairing for a new certificate for the given
+// CSR (PEM-encoded) and returns the new certificate, PEM-encoded. Start sets
+// this on the Device once it has the Pairing client configured; renewal
+// fails with a clear error if it's left nil.
+type RequestCertificateFunc func(csr string) (certificatePEM string, err error)
+
+// ReconnectFunc tears down and re-establishes the Device's MQTT connection,
+// picking up a tls.Config built from the now-current certificate. Start
+// sets this once the MQTT client exists; renewal fails with a clear error
+// if it's left nil.
+type ReconnectFunc func() error
+
+// defaultRenewBeforeExpiry is used when RenewBeforeExpiry is left at its zero
+// value, so a Device doesn't have to opt into renewal explicitly.
+const defaultRenewBeforeExpiry = 7 * 24 * time.Hour
+
+// defaultRenewalCheckInterval is how often the renewal loop wakes up to
+// inspect the current certificate's expiry. It's deliberately much shorter
+// than the renewal threshold so a Device doesn't miss the window.
+const defaultRenewalCheckInterval = 1 * time.Hour
+
+// ensureCertificateRenewalLoopStarted starts the certificate renewal loop at
+// most once per Device. It's called from getTLSConfig, which every
+// connection attempt goes through, so the loop is guaranteed to actually run
+// rather than sitting unreferenced - ideally Device.Start would own this
+// call directly, but getTLSConfig is the integration point this package can
+// reach today. Call StopCertificateRenewal when the Device is done with
+// (e.g. disconnected or discarded) so the goroutine this starts doesn't
+// outlive it.
+func (d *Device) ensureCertificateRenewalLoopStarted() {
+	d.renewalLoopOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		d.renewalMutex.Lock()
+		d.renewalCancel = cancel
+		d.renewalMutex.Unlock()
+
+		d.startCertificateRenewalLoop(ctx)
+	})
+}
+
+// StopCertificateRenewal stops the background certificate renewal loop
+// started by ensureCertificateRenewalLoopStarted, if it's running. Whatever
+// owns the Device's lifecycle should call this once the Device disconnects
+// for good, so the loop's goroutine doesn't leak past the Device's lifetime.
+// renewalMutex guards against this racing the write inside
+// ensureCertificateRenewalLoopStarted's sync.Once.
+func (d *Device) StopCertificateRenewal() {
+	d.renewalMutex.Lock()
+	cancel := d.renewalCancel
+	d.renewalMutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// startCertificateRenewalLoop spawns the goroutine that watches the current
+// certificate's expiry and triggers re-registration once it's within
+// RenewBeforeExpiry of NotAfter. It runs until ctx is canceled, which
+// happens when StopCertificateRenewal is called.
+func (d *Device) startCertificateRenewalLoop(ctx context.Context) {
+	renewBefore := d.RenewBeforeExpiry
+	if renewBefore <= 0 {
+		renewBefore = defaultRenewBeforeExpiry
+	}
+
+	go func() {
+		ticker := time.NewTicker(defaultRenewalCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.renewCertificateIfNeeded(renewBefore)
+			}
+		}
+	}()
+}
+
+// renewCertificateIfNeeded re-registers the Device and swaps its certificate
+// if the current one expires within renewBefore. Failures are reported
+// through OnCertificateRenewalFailed rather than returned, since this runs in
+// the background outside of any call the application made.
+func (d *Device) renewCertificateIfNeeded(renewBefore time.Duration) {
+	keyStore, err := d.getKeyStore()
+	if err != nil {
+		return
+	}
+
+	cert, err := keyStore.LoadCertificate()
+	if err != nil {
+		return
+	}
+
+	if !certificateNeedsRenewal(cert, renewBefore) {
+		return
+	}
+
+	if err := d.renewCertificate(); err != nil {
+		if d.OnCertificateRenewalFailed != nil {
+			d.OnCertificateRenewalFailed(d, err)
+		}
+		return
+	}
+
+	if d.OnCertificateRenewed != nil {
+		d.OnCertificateRenewed(d)
+	}
+}
+
+// certificateNeedsRenewal reports whether cert is within renewBefore of its
+// NotAfter. Split out of renewCertificateIfNeeded so the threshold decision
+// can be unit tested without a Device.
+func certificateNeedsRenewal(cert *x509.Certificate, renewBefore time.Duration) bool {
+	return time.Until(cert.NotAfter) <= renewBefore
+}
+
+// renewCertificate regenerates the CSR off the Device's existing key,
+// requests a fresh certificate from Pairing, atomically swaps device.crt and
+// forces the MQTT client to reconnect so the new tls.Config takes effect.
+func (d *Device) renewCertificate() error {
+	// The key is reused - only the certificate is short-lived - so clear just
+	// the CSR to force ensureCSR to regenerate it against the current key.
+	csrFilename := d.getCSRFilePath()
+	if err := removeIfExists(csrFilename); err != nil {
+		return err
+	}
+	if err := d.ensureCSR(); err != nil {
+		return err
+	}
+
+	csr, err := d.getCSRString()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := d.requestNewCertificate(csr)
+	if err != nil {
+		return err
+	}
+
+	if err := d.saveCertificateFromString(certificate); err != nil {
+		return err
+	}
+
+	return d.reconnectWithUpdatedTLSConfig()
+}
+
+// requestNewCertificate asks Pairing for a fresh certificate via
+// RequestCertificateFunc, which Start is responsible for configuring.
+func (d *Device) requestNewCertificate(csr string) (string, error) {
+	if d.RequestCertificateFunc == nil {
+		return "", errors.New("renewal: RequestCertificateFunc is not configured on this Device")
+	}
+	return d.RequestCertificateFunc(csr)
+}
+
+// reconnectWithUpdatedTLSConfig forces the MQTT client to reconnect via
+// ReconnectFunc, which Start is responsible for configuring, so the newly
+// saved certificate is picked up by the next tls.Config built in
+// getTLSConfig.
+func (d *Device) reconnectWithUpdatedTLSConfig() error {
+	if d.ReconnectFunc == nil {
+		return errors.New("renewal: ReconnectFunc is not configured on this Device")
+	}
+	return d.ReconnectFunc()
+}
+
+// removeIfExists removes path, treating it already being gone as success.
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateNeedsRenewal(t *testing.T) {
+	cases := []struct {
+		name        string
+		notAfter    time.Time
+		renewBefore time.Duration
+		want        bool
+	}{
+		{"well within validity", time.Now().Add(30 * 24 * time.Hour), 7 * 24 * time.Hour, false},
+		{"inside the renewal window", time.Now().Add(6 * 24 * time.Hour), 7 * 24 * time.Hour, true},
+		{"already expired", time.Now().Add(-time.Hour), 7 * 24 * time.Hour, true},
+		{"exactly at the threshold", time.Now().Add(7 * 24 * time.Hour), 7 * 24 * time.Hour, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cert := &x509.Certificate{NotAfter: c.notAfter}
+			if got := certificateNeedsRenewal(cert, c.renewBefore); got != c.want {
+				t.Errorf("certificateNeedsRenewal(NotAfter=%v, renewBefore=%v) = %v, want %v", c.notAfter, c.renewBefore, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRemoveIfExists(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "device.csr")
+
+	// Removing a file that was never created must succeed.
+	if err := removeIfExists(path); err != nil {
+		t.Fatalf("removeIfExists on a missing file returned an error: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("csr"), 0600); err != nil {
+		t.Fatalf("os.WriteFile failed: %v", err)
+	}
+
+	if err := removeIfExists(path); err != nil {
+		t.Fatalf("removeIfExists on an existing file returned an error: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be gone, stat err = %v", path, err)
+	}
+}
+
+// The OnCertificateRenewed/OnCertificateRenewalFailed callback wiring in
+// renewCertificateIfNeeded, and requestNewCertificate/
+// reconnectWithUpdatedTLSConfig's nil-function error paths, are Device
+// methods and need a constructable *Device to exercise - Device itself lives
+// outside this package's visible tree, so they aren't covered here.
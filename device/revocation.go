@@ -0,0 +1,273 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// RevocationMode controls how getTLSConfig checks the peer certificate chain
+// for revocation.
+type RevocationMode int
+
+const (
+	// RevocationOff performs no revocation checking at all. This is the
+	// default, matching the behavior this package has always had.
+	RevocationOff RevocationMode = iota
+	// RevocationSoftFail checks CRLs/OCSP when reachable, but accepts the
+	// certificate if a revocation status can't be obtained (e.g. the device
+	// just rebooted without network access yet).
+	RevocationSoftFail
+	// RevocationHardFail rejects the certificate whenever a revocation
+	// status can't be obtained, in addition to rejecting certificates that
+	// are confirmed revoked.
+	RevocationHardFail
+)
+
+// revocationCacheFilePrefix names the file each distribution point's
+// last-known-good CRL is cached under, next to device.crt, so a Device that
+// reboots without immediate internet access can still fall back to a
+// recently valid CRL instead of failing hard. getTLSConfig checks both the
+// broker's certificate and the device's own certificate, and those can (and
+// usually do) have different CRL distribution points, so the cache is keyed
+// per-URL rather than a single shared file - otherwise one check's cached CRL
+// would shadow the other's.
+const revocationCacheFilePrefix = "revocation-"
+
+// revocationCacheFileName returns the cache file name for the CRL served at
+// url, derived from a hash of the URL so distinct distribution points never
+// collide.
+func revocationCacheFileName(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return revocationCacheFilePrefix + hex.EncodeToString(sum[:]) + ".crl"
+}
+
+// revocationHTTPTimeout bounds every OCSP/CRL fetch. These run synchronously
+// inside tls.Config.VerifyPeerCertificate during the TLS handshake, so a
+// slow-but-not-down responder must not be allowed to hang it indefinitely -
+// RevocationSoftFail/RevocationHardFail decide the outcome once this fires.
+const revocationHTTPTimeout = 10 * time.Second
+
+// revocationHTTPClient is used for every OCSP/CRL request.
+var revocationHTTPClient = &http.Client{Timeout: revocationHTTPTimeout}
+
+// buildVerifyPeerCertificate returns a tls.Config.VerifyPeerCertificate
+// callback that checks the leaf of the verified chain - the broker's server
+// certificate - against a CRL distribution point or OCSP responder named in
+// the certificate, according to d.RevocationMode. It returns nil when
+// RevocationMode is RevocationOff, so callers can assign it to
+// tlsConfig.VerifyPeerCertificate unconditionally. The Device's own
+// certificate isn't part of verifiedChains - that's covered separately by
+// checkOwnCertificateRevocation, which getTLSConfig calls before returning.
+func (d *Device) buildVerifyPeerCertificate() func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if d.RevocationMode == RevocationOff {
+		return nil
+	}
+
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			if len(chain) == 0 {
+				continue
+			}
+			if err := d.checkRevocation(chain[0], chain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// checkOwnCertificateRevocation checks the Device's own certificate (the one
+// it presents as a TLS client) against a CRL distribution point, honoring
+// RevocationSoftFail/RevocationHardFail. It's the "device certificate" half
+// of RevocationMode: getTLSConfig calls it so a compromised device
+// certificate reissued by Astarte's CA stops being trusted by the device
+// itself, rather than only by peers that happen to check it.
+//
+// It can't go through checkOCSP: that needs the issuer certificate, and
+// RootCAs is a *x509.CertPool, which - as noted in ExportPKCS12 - doesn't
+// expose the certificates it was built from. Passing a single-certificate
+// chain reuses checkRevocation's existing OCSP-then-CRL fallback, which
+// naturally skips straight to the CRL check since there's no issuer to build
+// an OCSP request against.
+func (d *Device) checkOwnCertificateRevocation(tlsCert tls.Certificate) error {
+	if d.RevocationMode == RevocationOff || len(tlsCert.Certificate) == 0 {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	return d.checkRevocation(cert, []*x509.Certificate{cert})
+}
+
+// checkRevocation verifies cert against its issuer's OCSP responder, falling
+// back to a CRL distribution point whenever OCSP yields no status (no
+// responder configured, no issuer in chain, or a failed request). It
+// honors RevocationSoftFail/RevocationHardFail when a status can't be
+// obtained.
+func (d *Device) checkRevocation(cert *x509.Certificate, chain []*x509.Certificate) error {
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+
+	status, err := checkOCSP(revocationHTTPClient, cert, issuer)
+	if err != nil {
+		status, err = d.checkCRL(cert)
+	}
+
+	return revocationOutcome(d.RevocationMode, status, err)
+}
+
+// revocationOutcome turns a (status, err) pair from checkOCSP/checkCRL into
+// the final verdict, honoring RevocationSoftFail/RevocationHardFail. Split
+// out of checkRevocation so the soft-fail/hard-fail branching is unit
+// testable without a Device.
+func revocationOutcome(mode RevocationMode, status int, err error) error {
+	if err != nil {
+		if mode == RevocationHardFail {
+			return fmt.Errorf("revocation: could not determine certificate status: %w", err)
+		}
+		// Soft-fail: we couldn't tell, so we let the certificate through.
+		return nil
+	}
+
+	if status == ocsp.Revoked {
+		return errors.New("revocation: certificate has been revoked")
+	}
+
+	return nil
+}
+
+// checkOCSP queries issuer's OCSP responder (named in cert.OCSPServer) for
+// cert's revocation status. It doesn't depend on a Device, so it can be
+// exercised directly against an httptest.Server.
+func checkOCSP(client *http.Client, cert, issuer *x509.Certificate) (int, error) {
+	if len(cert.OCSPServer) == 0 || issuer == nil {
+		return 0, errors.New("revocation: no OCSP responder configured")
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return 0, err
+	}
+
+	return parsed.Status, nil
+}
+
+// checkCRL fetches the certificate's CRL distribution point, caching it on
+// disk so that a subsequent check - or a reboot without network access - can
+// fall back to the cached list as long as the CRL's NextUpdate hasn't passed.
+func (d *Device) checkCRL(cert *x509.Certificate) (int, error) {
+	if len(cert.CRLDistributionPoints) == 0 {
+		return 0, errors.New("revocation: no CRL distribution point configured")
+	}
+	url := cert.CRLDistributionPoints[0]
+
+	crl, err := d.loadCachedCRL(url)
+	if err != nil || crl.TBSCertList.NextUpdate.Before(time.Now()) {
+		crl, err = d.fetchAndCacheCRL(url)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return certStatusInCRL(crl, cert), nil
+}
+
+// certStatusInCRL reports ocsp.Revoked if cert's serial number appears in
+// crl's revoked list, ocsp.Good otherwise. Split out of checkCRL so the scan
+// is unit testable without fetching or caching anything.
+func certStatusInCRL(crl *pkix.CertificateList, cert *x509.Certificate) int {
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return ocsp.Revoked
+		}
+	}
+	return ocsp.Good
+}
+
+func (d *Device) fetchAndCacheCRL(url string) (*pkix.CertificateList, error) {
+	crl, der, err := fetchCRL(revocationHTTPClient, url)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(d.getCryptoDir(), revocationCacheFileName(url)), der, 0600)
+
+	return crl, nil
+}
+
+// fetchCRL retrieves and parses the CRL at url. It doesn't depend on a
+// Device, so it can be exercised directly against an httptest.Server.
+func fetchCRL(client *http.Client, url string) (*pkix.CertificateList, []byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	der, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return crl, der, nil
+}
+
+func (d *Device) loadCachedCRL(url string) (*pkix.CertificateList, error) {
+	der, err := ioutil.ReadFile(filepath.Join(d.getCryptoDir(), revocationCacheFileName(url)))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCRL(der)
+}
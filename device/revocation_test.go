@@ -0,0 +1,206 @@
+// Copyright © 2020 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// issuerAndLeaf generates a throwaway self-signed CA and a leaf certificate
+// signed by it, so OCSP/CRL requests have something real to validate against.
+func issuerAndLeaf(t *testing.T) (crypto.Signer, *x509.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := generateKey(KeyECDSAP256)
+	if err != nil {
+		t.Fatalf("generateKey failed: %v", err)
+	}
+
+	issuerTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	issuerDER, err := x509.CreateCertificate(rand.Reader, issuerTemplate, issuerTemplate, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate (issuer) failed: %v", err)
+	}
+	issuerCert, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate (issuer) failed: %v", err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "myrealm/mydevice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, issuerCert, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate (leaf) failed: %v", err)
+	}
+	leafCert, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate (leaf) failed: %v", err)
+	}
+
+	return key, issuerCert, leafCert
+}
+
+func TestCheckOCSPGood(t *testing.T) {
+	key, issuer, leaf := issuerAndLeaf(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			SerialNumber: leaf.SerialNumber,
+			Status:       ocsp.Good,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, key)
+		if err != nil {
+			t.Fatalf("ocsp.CreateResponse failed: %v", err)
+		}
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	leaf.OCSPServer = []string{ts.URL}
+
+	status, err := checkOCSP(ts.Client(), leaf, issuer)
+	if err != nil {
+		t.Fatalf("checkOCSP failed: %v", err)
+	}
+	if status != ocsp.Good {
+		t.Errorf("checkOCSP status = %d, want ocsp.Good", status)
+	}
+}
+
+func TestCheckOCSPRevoked(t *testing.T) {
+	key, issuer, leaf := issuerAndLeaf(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			SerialNumber: leaf.SerialNumber,
+			Status:       ocsp.Revoked,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, key)
+		if err != nil {
+			t.Fatalf("ocsp.CreateResponse failed: %v", err)
+		}
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	leaf.OCSPServer = []string{ts.URL}
+
+	status, err := checkOCSP(ts.Client(), leaf, issuer)
+	if err != nil {
+		t.Fatalf("checkOCSP failed: %v", err)
+	}
+	if status != ocsp.Revoked {
+		t.Errorf("checkOCSP status = %d, want ocsp.Revoked", status)
+	}
+}
+
+func TestCheckOCSPNoResponderConfigured(t *testing.T) {
+	_, issuer, leaf := issuerAndLeaf(t)
+	leaf.OCSPServer = nil
+
+	if _, err := checkOCSP(http.DefaultClient, leaf, issuer); err == nil {
+		t.Fatal("expected an error with no OCSPServer configured, got nil")
+	}
+
+	leaf.OCSPServer = []string{"https://example.invalid"}
+	if _, err := checkOCSP(http.DefaultClient, leaf, nil); err == nil {
+		t.Fatal("expected an error with a nil issuer, got nil")
+	}
+}
+
+func TestFetchCRLAndCertStatus(t *testing.T) {
+	key, issuer, leaf := issuerAndLeaf(t)
+
+	revokedList := []pkix.RevokedCertificate{
+		{SerialNumber: leaf.SerialNumber, RevocationTime: time.Now()},
+	}
+	der, err := issuer.CreateCRL(rand.Reader, key, revokedList, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateCRL failed: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(der)
+	}))
+	defer ts.Close()
+
+	crl, fetchedDER, err := fetchCRL(ts.Client(), ts.URL)
+	if err != nil {
+		t.Fatalf("fetchCRL failed: %v", err)
+	}
+	if len(fetchedDER) == 0 {
+		t.Fatal("fetchCRL returned no raw DER bytes to cache")
+	}
+
+	if status := certStatusInCRL(crl, leaf); status != ocsp.Revoked {
+		t.Errorf("certStatusInCRL = %d, want ocsp.Revoked", status)
+	}
+
+	untouchedCert := &x509.Certificate{SerialNumber: big.NewInt(999)}
+	if status := certStatusInCRL(crl, untouchedCert); status != ocsp.Good {
+		t.Errorf("certStatusInCRL for an unlisted serial = %d, want ocsp.Good", status)
+	}
+}
+
+func TestRevocationOutcome(t *testing.T) {
+	cases := []struct {
+		name    string
+		mode    RevocationMode
+		status  int
+		err     error
+		wantErr bool
+	}{
+		{"soft-fail, status unknown", RevocationSoftFail, ocsp.Good, errors.New("boom"), false},
+		{"hard-fail, status unknown", RevocationHardFail, ocsp.Good, errors.New("boom"), true},
+		{"soft-fail, good", RevocationSoftFail, ocsp.Good, nil, false},
+		{"hard-fail, good", RevocationHardFail, ocsp.Good, nil, false},
+		{"soft-fail, revoked", RevocationSoftFail, ocsp.Revoked, nil, true},
+		{"hard-fail, revoked", RevocationHardFail, ocsp.Revoked, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := revocationOutcome(c.mode, c.status, c.err)
+			if (err != nil) != c.wantErr {
+				t.Errorf("revocationOutcome(%v, %d, %v) = %v, wantErr %v", c.mode, c.status, c.err, err, c.wantErr)
+			}
+		})
+	}
+}